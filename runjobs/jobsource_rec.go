@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// recJobSource parses a recfile-style manifest: records are separated by
+// blank lines, and each record is a set of "Key: Value" lines. Recognized
+// keys are Cmd, Arg (repeatable), Env (repeatable, KEY=VAL), Cwd, Id,
+// Stdin, and Needs (repeatable, a job ID this job depends on). This mirrors
+// goredo's .rec dep records and lets a manifest carry per-job env vars,
+// working directories, stdin redirection, and dependency edges that the
+// whitespace-split line format has no room for. -F dep / a .dep extension
+// select the same parser, and Needs is honored in either format, so there is
+// no separate dep parser to drift out of sync with this one.
+type recJobSource struct {
+	scanner    *bufio.Scanner
+	closer     io.Closer
+	binPath    string
+	sharedArgs []string
+	index      int
+}
+
+func newRecJobSource(binPath string, sharedArgs []string, reader io.Reader, closer io.Closer) *recJobSource {
+	sc := bufio.NewScanner(reader)
+	buf := make([]byte, 0, 64*1024)
+	sc.Buffer(buf, 10*1024*1024)
+	return &recJobSource{
+		scanner:    sc,
+		closer:     closer,
+		binPath:    binPath,
+		sharedArgs: append([]string(nil), sharedArgs...),
+	}
+}
+
+func (s *recJobSource) Next(ctx context.Context) (Job, bool, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return Job{}, false, err
+		}
+
+		lines, err := readRecRecord(s.scanner)
+		if err != nil {
+			return Job{}, false, err
+		}
+		if lines == nil {
+			return Job{}, false, nil
+		}
+		if len(lines) == 0 {
+			continue
+		}
+
+		job, err := s.buildJob(lines)
+		if err != nil {
+			return Job{}, false, err
+		}
+		return job, true, nil
+	}
+}
+
+// readRecRecord reads lines up to (and consuming) the next blank line or
+// EOF, for any recfile-style manifest. It returns nil, nil at EOF once all
+// records have been consumed.
+func readRecRecord(sc *bufio.Scanner) ([]string, error) {
+	var lines []string
+	sawLine := false
+	for sc.Scan() {
+		sawLine = true
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		if line == "" {
+			if lines == nil {
+				// An empty record (a run of blank lines) is not EOF.
+				return []string{}, nil
+			}
+			return lines, nil
+		}
+		lines = append(lines, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if !sawLine {
+		return nil, nil
+	}
+	return lines, nil
+}
+
+func (s *recJobSource) buildJob(lines []string) (Job, error) {
+	var (
+		cmd   string
+		id    string
+		cwd   string
+		stdin string
+		args  []string
+		needs []string
+		env   map[string]string
+	)
+
+	for _, line := range lines {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return Job{}, fmt.Errorf("rec: malformed field %q (want \"Key: Value\")", line)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "Cmd":
+			cmd = value
+		case "Arg":
+			args = append(args, value)
+		case "Env":
+			k, v, ok := strings.Cut(value, "=")
+			if !ok {
+				return Job{}, fmt.Errorf("rec: malformed Env field %q (want KEY=VAL)", value)
+			}
+			if env == nil {
+				env = make(map[string]string)
+			}
+			env[k] = v
+		case "Cwd":
+			cwd = value
+		case "Id":
+			id = value
+		case "Stdin":
+			stdin = value
+		case "Needs":
+			needs = append(needs, value)
+		default:
+			return Job{}, fmt.Errorf("rec: unknown field %q", key)
+		}
+	}
+
+	if cmd == "" {
+		cmd = s.binPath
+	}
+	if id == "" {
+		s.index++
+		id = fmt.Sprintf("%s-%d", filepath.Base(cmd), s.index)
+	}
+
+	allArgs := make([]string, 0, len(s.sharedArgs)+len(args))
+	allArgs = append(allArgs, s.sharedArgs...)
+	allArgs = append(allArgs, args...)
+
+	return Job{
+		ID:    id,
+		Cmd:   cmd,
+		Args:  allArgs,
+		Env:   env,
+		Cwd:   cwd,
+		Stdin: stdin,
+		Needs: needs,
+	}, nil
+}
+
+func (s *recJobSource) Close() error {
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
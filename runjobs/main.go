@@ -7,21 +7,26 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type Job struct {
-	ID   string
-	Cmd  string
-	Args []string
-	Env  map[string]string
-	Cwd  string
+	ID    string
+	Cmd   string
+	Args  []string
+	Env   map[string]string
+	Cwd   string
+	Stdin string
+	Needs []string
 }
 
 type JobSource interface {
@@ -37,7 +42,38 @@ type scannerJobSource struct {
 	index      int
 }
 
-func newJobSource(binPath string, sharedArgs []string, path string) (JobSource, error) {
+// jobFormat identifies how a job manifest should be parsed.
+type jobFormat string
+
+const (
+	formatLines jobFormat = "lines"
+	formatRec   jobFormat = "rec"
+	formatDep   jobFormat = "dep"
+)
+
+func resolveJobFormat(format, path string) (jobFormat, error) {
+	switch format {
+	case "":
+		switch filepath.Ext(path) {
+		case ".rec":
+			return formatRec, nil
+		case ".dep":
+			return formatDep, nil
+		default:
+			return formatLines, nil
+		}
+	case string(formatLines):
+		return formatLines, nil
+	case string(formatRec):
+		return formatRec, nil
+	case string(formatDep):
+		return formatDep, nil
+	default:
+		return "", fmt.Errorf("unknown -F format %q (want %q, %q, or %q)", format, formatLines, formatRec, formatDep)
+	}
+}
+
+func newJobSource(binPath string, sharedArgs []string, path string, format jobFormat) (JobSource, error) {
 	var (
 		reader io.Reader
 		closer io.Closer
@@ -53,6 +89,14 @@ func newJobSource(binPath string, sharedArgs []string, path string) (JobSource,
 		closer = f
 	}
 
+	switch format {
+	case formatRec, formatDep:
+		// formatDep is the same recfile parser as formatRec; it only exists
+		// as a distinct -F value / .dep extension so a manifest that relies
+		// on Needs edges can say so explicitly.
+		return newRecJobSource(binPath, sharedArgs, reader, closer), nil
+	}
+
 	sc := bufio.NewScanner(reader)
 	buf := make([]byte, 0, 64*1024)
 	sc.Buffer(buf, 10*1024*1024)
@@ -105,6 +149,21 @@ func (s *scannerJobSource) Close() error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		if err := runReport(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(2)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "clean" {
+		if err := runClean(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(2)
+		}
+		return
+	}
+
 	var (
 		inputFile    string
 		binPath      string
@@ -113,6 +172,21 @@ func main() {
 		workingDir   string
 		printVersion bool
 		printCmd     bool
+		logDir       string
+		keepLogs     bool
+		silentOutput bool
+		stderrPrefix string
+		formatFlag   string
+		traceMode    bool
+		jsonLogPath  string
+		retries      int
+		retryBackoff time.Duration
+		retryMax     time.Duration
+		jitter       float64
+		timeout      time.Duration
+		noRetryExit  string
+		queueDir     string
+		resume       bool
 	)
 
 	args := os.Args[1:]
@@ -174,7 +248,9 @@ func main() {
 	fs.SetOutput(os.Stderr)
 	fs.Usage = func() {
 		out := fs.Output()
-		fmt.Fprintf(out, "Usage: %s -b path [-f jobs.txt | --] [-p N] [-x] [-C dir] [-e] [-a shared... [--]]\n", os.Args[0])
+		fmt.Fprintf(out, "Usage: %s -b path [-f jobs.txt | --] [-p N] [-x] [-C dir] [-e] [-logdir dir] [-logs] [-silent] [-prefix fmt] [-trace] [-json file] [-retry N] [-retry-backoff dur] [-retry-max dur] [-jitter frac] [-timeout dur] [-no-retry-exit list] [-a shared... [--]]\n", os.Args[0])
+		fmt.Fprintf(out, "       %s report <file.jsonl>\n", os.Args[0])
+		fmt.Fprintf(out, "       %s clean <dir>\n", os.Args[0])
 		fmt.Fprintln(out)
 		fmt.Fprintln(out, "Options:")
 		fs.PrintDefaults()
@@ -188,6 +264,21 @@ func main() {
 	fs.StringVar(&workingDir, "C", "", "Change directory before running any jobs.")
 	fs.BoolVar(&printVersion, "V", false, "Print version and exit.")
 	fs.BoolVar(&printCmd, "e", false, "Echo each job's command and arguments before execution.")
+	fs.StringVar(&logDir, "logdir", "", "Directory to write per-job <jobid>.log files capturing stderr.")
+	fs.BoolVar(&keepLogs, "logs", false, "Retain per-job log files even when the job succeeds.")
+	fs.BoolVar(&silentOutput, "silent", false, "Suppress live prefixed stderr streaming; log files are still written. Requires -logdir (otherwise there would be nowhere to find the suppressed output), unless -trace is also given.")
+	fs.StringVar(&stderrPrefix, "prefix", "", "Printf-style prefix applied to each streamed stderr line; %s is replaced with the job ID. Default: no prefix (stderr streams through unchanged), unless -logdir or -trace is also given, in which case \"[%s] \" is used so concurrent jobs' interleaved lines stay attributable.")
+	fs.StringVar(&formatFlag, "F", "", "Job manifest format: \"lines\", \"rec\", or \"dep\" (default: detected from -f's extension, .rec/.dep select rec/dep).")
+	fs.BoolVar(&traceMode, "trace", false, "Set RUNJOBS_TRACE=1 in job environments and always prefix streamed stderr lines with the job ID.")
+	fs.StringVar(&jsonLogPath, "json", "", "Append a JSON-Lines event stream (run_started, job_started, job_finished, run_finished) to this file.")
+	fs.IntVar(&retries, "retry", 0, "Retry a failing job up to N additional times.")
+	fs.DurationVar(&retryBackoff, "retry-backoff", time.Second, "Initial delay before a retry; doubles after each attempt.")
+	fs.DurationVar(&retryMax, "retry-max", 0, "Cap on the retry backoff delay (0: uncapped).")
+	fs.Float64Var(&jitter, "jitter", 0, "Fraction of the backoff delay to randomize (0-1), to avoid thundering-herd retries.")
+	fs.DurationVar(&timeout, "timeout", 0, "Per-attempt wall clock timeout (0: none).")
+	fs.StringVar(&noRetryExit, "no-retry-exit", "", "Comma-separated exit codes that should never be retried.")
+	fs.StringVar(&queueDir, "queue", "", "Coordinate with other runjobs processes sharing this manifest via per-job lockfiles under <dir>/.runjobs.")
+	fs.BoolVar(&resume, "resume", false, "With -queue, skip jobs that already have a .done marker from a previous run.")
 	if err := fs.Parse(coreArgs); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
 			return
@@ -234,7 +325,30 @@ func main() {
 		}
 	}
 
-	jobSrc, err := newJobSource(binPath, sharedArgs, inputFile)
+	if logDir != "" {
+		if err := os.MkdirAll(logDir, 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "error: logdir %q: %v\n", logDir, err)
+			os.Exit(2)
+		}
+	}
+
+	if resume && queueDir == "" {
+		fmt.Fprintln(os.Stderr, "error: -resume requires -queue")
+		os.Exit(2)
+	}
+
+	if silentOutput && logDir == "" && !traceMode {
+		fmt.Fprintln(os.Stderr, "error: -silent requires -logdir (otherwise every job's stderr is discarded with nowhere to find it); -trace overrides -silent's echo suppression, so it is exempt")
+		os.Exit(2)
+	}
+
+	format, err := resolveJobFormat(formatFlag, inputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(2)
+	}
+
+	jobSrc, err := newJobSource(binPath, sharedArgs, inputFile, format)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: load jobs: %v\n", err)
 		os.Exit(2)
@@ -257,38 +371,153 @@ func main() {
 		cancel()
 	}()
 
-	successCount, failCount, totalJobs, runErr := runJobs(ctx, jobSrc, maxParallel, stopOnError, printCmd)
+	buildUUID, err := newBuildUUID()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: generate build uuid: %v\n", err)
+		os.Exit(2)
+	}
+
+	events, err := newEventLog(jsonLogPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: open -json %q: %v\n", jsonLogPath, err)
+		os.Exit(2)
+	}
+	defer func() { _ = events.Close() }()
+
+	noRetryExitSet, err := parseExitCodeSet(noRetryExit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: -no-retry-exit: %v\n", err)
+		os.Exit(2)
+	}
+
+	outOpts := outputOptions{
+		printCmd:     printCmd,
+		logDir:       logDir,
+		keepLogs:     keepLogs,
+		silent:       silentOutput,
+		prefix:       stderrPrefix,
+		mu:           &sync.Mutex{},
+		trace:        traceMode,
+		buildUUID:    buildUUID,
+		events:       events,
+		retries:      retries,
+		retryBackoff: retryBackoff,
+		retryMax:     retryMax,
+		jitter:       jitter,
+		timeout:      timeout,
+		noRetryExit:  noRetryExitSet,
+		queueDir:     queueDir,
+		resume:       resume,
+	}
+
+	successCount, failCount, timedOutCount, skippedCount, queueSkippedCount, totalJobs, retainedLogs, runErr := runJobs(ctx, jobSrc, maxParallel, stopOnError, outOpts)
 	if runErr != nil && !errors.Is(runErr, context.Canceled) && !errors.Is(runErr, context.DeadlineExceeded) {
 		fmt.Fprintf(os.Stderr, "error: %v\n", runErr)
 		os.Exit(2)
 	}
 
-	fmt.Printf("jobs total=%d success=%d failed=%d\n", totalJobs, successCount, failCount)
+	fmt.Printf("jobs total=%d success=%d failed=%d timed_out=%d skipped=%d queue_skipped=%d\n", totalJobs, successCount, failCount, timedOutCount, skippedCount, queueSkippedCount)
+
+	if len(retainedLogs) > 0 {
+		fmt.Println("logs retained for failed jobs:")
+		for _, p := range retainedLogs {
+			fmt.Printf("  %s\n", p)
+		}
+	}
 
-	if failCount > 0 {
+	// queueSkippedCount reflects jobs another -queue worker already owned or
+	// finished, not a failure of this run, so it must not affect the exit
+	// code: a -queue -resume run where everything was already done should
+	// exit 0.
+	if failCount > 0 || skippedCount > 0 {
 		os.Exit(1)
 	}
 }
 
-func runJobs(ctx context.Context, src JobSource, maxParallel int, stopOnError bool, printCmd bool) (int, int, int, error) {
-	sema := make(chan struct{}, maxParallel)
+// outputOptions bundles the per-run settings that control how a job's
+// output is echoed, captured, and retained. mu guards prefixed stderr
+// writes so lines from concurrent jobs are never interleaved mid-line.
+type outputOptions struct {
+	printCmd  bool
+	logDir    string
+	keepLogs  bool
+	silent    bool
+	prefix    string
+	mu        *sync.Mutex
+	trace     bool
+	buildUUID string
+	events    *eventLog
+
+	retries      int
+	retryBackoff time.Duration
+	retryMax     time.Duration
+	jitter       float64
+	timeout      time.Duration
+	noRetryExit  map[int]bool
+
+	queueDir string
+	resume   bool
+}
+
+// loadJobs drains every job from src. The DAG scheduler needs the whole
+// job set up front so it can validate edges and detect cycles before
+// anything starts running.
+func loadJobs(ctx context.Context, src JobSource) ([]Job, error) {
+	var jobs []Job
+	for {
+		job, ok, err := src.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return jobs, nil
+		}
+		jobs = append(jobs, job)
+	}
+}
+
+// runJobs schedules jobs as a dependency DAG: a job only starts once every
+// job named in its Needs has finished successfully, and failure of a
+// predecessor transitively skips its descendants. maxParallel still bounds
+// how many jobs may be actually running (not merely waiting on deps) at
+// once.
+func runJobs(ctx context.Context, src JobSource, maxParallel int, stopOnError bool, outOpts outputOptions) (int, int, int, int, int, int, []string, error) {
+	jobs, err := loadJobs(ctx, src)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return 0, 0, 0, 0, 0, len(jobs), nil, nil
+		}
+		return 0, 0, 0, 0, 0, 0, nil, err
+	}
+
+	nodes, order, err := buildDAG(jobs)
+	if err != nil {
+		return 0, 0, 0, 0, 0, len(jobs), nil, err
+	}
+	totalJobs := len(jobs)
+
+	outOpts.events.emit(event{Type: "run_started", BuildUUID: outOpts.buildUUID})
+
 	var (
-		wg           sync.WaitGroup
-		onceFail     sync.Once
-		cancelFn     context.CancelFunc
-		startMu      sync.Mutex
-		startCond    = sync.NewCond(&startMu)
-		nextToStart  int
-		countMu      sync.Mutex
-		progressMu   sync.Mutex
-		successCount int
-		failCount    int
-		totalJobs    int
-		finishedJobs int
+		wg                sync.WaitGroup
+		onceFail          sync.Once
+		cancelFn          context.CancelFunc
+		countMu           sync.Mutex
+		progressMu        sync.Mutex
+		successCount      int
+		failCount         int
+		timedOutCount     int
+		skippedCount      int
+		queueSkippedCount int
+		finishedJobs      int
+		attemptCount      int
+		retainedLogs      []string
 	)
 	ctx, cancelFn = context.WithCancel(ctx)
 	defer cancelFn()
 
+	sema := make(chan struct{}, maxParallel)
+
 	// Setup progress bar if TTY
 	showProgress := isTerminal(os.Stdout)
 	if showProgress {
@@ -307,6 +536,8 @@ func runJobs(ctx context.Context, src JobSource, maxParallel int, stopOnError bo
 		total := totalJobs
 		success := successCount
 		failed := failCount
+		skipped := skippedCount
+		attempts := attemptCount
 		countMu.Unlock()
 		// Save current position, move to bottom, print progress, restore position
 		fmt.Print("\033[s")      // Save cursor
@@ -314,76 +545,123 @@ func runJobs(ctx context.Context, src JobSource, maxParallel int, stopOnError bo
 		fmt.Print("\033[K")      // Clear line
 		if total > 0 {
 			fmt.Print("\033[32m") // Green color
-			fmt.Printf("[%d/%d] jobs completed (success: %d, failed: %d)", finished, total, success, failed)
+			fmt.Printf("[%d/%d] jobs completed (success: %d, failed: %d, skipped: %d, attempts: %d)", finished, total, success, failed, skipped, attempts)
 			fmt.Print("\033[0m") // Reset color
 		}
 		fmt.Print("\033[u") // Restore cursor
 	}
 
-	var iterationErr error
-
-	for {
-		job, ok, err := src.Next(ctx)
-		if err != nil {
-			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-				break
-			}
-			iterationErr = err
-			break
-		}
-		if !ok {
-			break
-		}
-		idx := totalJobs
+	onAttempt := func() {
 		countMu.Lock()
-		totalJobs++
+		attemptCount++
 		countMu.Unlock()
 		updateProgress()
+	}
 
+	for _, id := range order {
 		wg.Add(1)
-		go func(job Job, idx int) {
+		go func(id string) {
 			defer wg.Done()
+			node := nodes[id]
+			defer close(node.done)
 
-			releaseOnce := func() {
-				startMu.Lock()
-				if nextToStart == idx {
-					nextToStart++
-					startCond.Broadcast()
+			skip := false
+			for _, need := range node.job.Needs {
+				dep := nodes[need]
+				<-dep.done
+				if dep.failed {
+					skip = true
 				}
-				startMu.Unlock()
 			}
-			released := false
-			release := func() {
-				if !released {
-					released = true
-					releaseOnce()
-				}
+			if !skip && ctx.Err() != nil {
+				skip = true
+			}
+
+			if skip {
+				node.failed = true
+				countMu.Lock()
+				skippedCount++
+				finishedJobs++
+				countMu.Unlock()
+				updateProgress()
+				return
 			}
-			defer release()
 
 			select {
 			case sema <- struct{}{}:
 				defer func() { <-sema }()
 			case <-ctx.Done():
+				node.failed = true
 				countMu.Lock()
-				failCount++
+				skippedCount++
 				finishedJobs++
 				countMu.Unlock()
 				updateProgress()
 				return
 			}
 
-			startMu.Lock()
-			for idx != nextToStart {
-				startCond.Wait()
+			// In -queue mode, other runjobs processes may be sharing this
+			// same manifest over a shared filesystem. A .done marker (with
+			// -resume) or a lock held by another process both mean this job
+			// is someone else's responsibility. Neither is a DAG failure, so
+			// node.failed stays false and dependents proceed once the job
+			// is actually done; they are counted separately from DAG/cancel
+			// skips so they don't flip the process exit code. This only
+			// runs once we already hold a local semaphore slot, so a
+			// process never reserves more jobs' locks than it can actually
+			// run concurrently, leaving the rest for peers sharing -queue.
+			var queueLock *os.File
+			if outOpts.queueDir != "" {
+				if outOpts.resume && queueJobDone(outOpts.queueDir, node.job.ID) {
+					countMu.Lock()
+					queueSkippedCount++
+					finishedJobs++
+					countMu.Unlock()
+					updateProgress()
+					return
+				}
+				lock, done, err := waitForQueueClaim(ctx, outOpts.queueDir, node.job.ID)
+				if err != nil {
+					node.failed = true
+					countMu.Lock()
+					if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+						skippedCount++
+					} else {
+						failCount++
+					}
+					finishedJobs++
+					countMu.Unlock()
+					updateProgress()
+					return
+				}
+				if done {
+					countMu.Lock()
+					queueSkippedCount++
+					finishedJobs++
+					countMu.Unlock()
+					updateProgress()
+					return
+				}
+				queueLock = lock
+				defer queueLock.Close()
 			}
-			startMu.Unlock()
 
-			exitCode, err := runOne(ctx, job, printCmd, release)
+			exitCode, runErr, logPath, timedOut := runOne(ctx, node.job, outOpts, onAttempt)
+			failed := runErr != nil || exitCode != 0
+			node.failed = failed
+			if outOpts.queueDir != "" && !failed {
+				_ = markQueueJobDone(outOpts.queueDir, node.job.ID)
+			}
 			countMu.Lock()
 			finishedJobs++
-			if err != nil || exitCode != 0 {
+			if failed {
 				failCount++
+				if timedOut {
+					timedOutCount++
+				}
+				if logPath != "" {
+					retainedLogs = append(retainedLogs, logPath)
+				}
 			} else {
 				successCount++
 			}
@@ -391,10 +669,10 @@ func runJobs(ctx context.Context, src JobSource, maxParallel int, stopOnError bo
 
 			updateProgress()
 
-			if (err != nil || exitCode != 0) && stopOnError {
+			if failed && stopOnError {
 				onceFail.Do(func() { cancelFn() })
 			}
-		}(job, idx)
+		}(id)
 	}
 
 	wg.Wait()
@@ -405,7 +683,17 @@ func runJobs(ctx context.Context, src JobSource, maxParallel int, stopOnError bo
 		fmt.Print("\033[u")            // Restore original cursor position
 	}
 
-	return successCount, failCount, totalJobs, iterationErr
+	outOpts.events.emit(event{
+		Type:         "run_finished",
+		BuildUUID:    outOpts.buildUUID,
+		Total:        totalJobs,
+		Success:      successCount,
+		Failed:       failCount,
+		Skipped:      skippedCount,
+		QueueSkipped: queueSkippedCount,
+	})
+
+	return successCount, failCount, timedOutCount, skippedCount, queueSkippedCount, totalJobs, retainedLogs, nil
 }
 
 func isTerminal(f *os.File) bool {
@@ -416,11 +704,83 @@ func isTerminal(f *os.File) bool {
 	return stat.Mode()&os.ModeCharDevice != 0
 }
 
-func runOne(ctx context.Context, job Job, printCmd bool, onStarted func()) (int, error) {
+// runOne runs a job, retrying on failure up to opts.retries times with
+// exponential backoff (capped at opts.retryMax, randomized by opts.jitter)
+// between attempts. onAttempt, if non-nil, is invoked after each attempt
+// starts so callers can refresh a progress display.
+func runOne(ctx context.Context, job Job, opts outputOptions, onAttempt func()) (int, error, string, bool) {
+	backoff := opts.retryBackoff
+	if opts.retryMax > 0 && backoff > opts.retryMax {
+		backoff = opts.retryMax
+	}
+	var (
+		exitCode int
+		runErr   error
+		logPath  string
+		timedOut bool
+	)
+	for attempt := 1; ; attempt++ {
+		exitCode, runErr, logPath, timedOut = runAttempt(ctx, job, opts, attempt, onAttempt)
+		failed := runErr != nil || exitCode != 0
+		if !failed {
+			return exitCode, runErr, logPath, timedOut
+		}
+		if ctx.Err() != nil {
+			return exitCode, runErr, logPath, timedOut
+		}
+		if attempt > opts.retries {
+			return exitCode, runErr, logPath, timedOut
+		}
+		if !timedOut && opts.noRetryExit[exitCode] {
+			return exitCode, runErr, logPath, timedOut
+		}
+
+		wait := applyJitter(backoff, opts.jitter)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return exitCode, runErr, logPath, timedOut
+		}
+
+		if backoff > 0 {
+			backoff *= 2
+			if opts.retryMax > 0 && backoff > opts.retryMax {
+				backoff = opts.retryMax
+			}
+		}
+	}
+}
+
+// applyJitter randomizes d by up to the given fraction in either
+// direction, to avoid many retrying jobs hammering a downstream service
+// in lockstep.
+func applyJitter(d time.Duration, jitter float64) time.Duration {
+	if d <= 0 || jitter <= 0 {
+		return d
+	}
+	spread := float64(d) * jitter
+	d += time.Duration(spread*rand.Float64()*2 - spread)
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// runAttempt runs a single attempt of a job, applying opts.timeout as a
+// per-attempt wall clock limit.
+func runAttempt(ctx context.Context, job Job, opts outputOptions, attempt int, onAttempt func()) (int, error, string, bool) {
 	if job.Cmd == "" {
-		return 1, errors.New("empty command")
+		return 1, errors.New("empty command"), "", false
+	}
+
+	attemptCtx := ctx
+	if opts.timeout > 0 {
+		var cancelAttempt context.CancelFunc
+		attemptCtx, cancelAttempt = context.WithTimeout(ctx, opts.timeout)
+		defer cancelAttempt()
 	}
-	cmd := exec.CommandContext(ctx, job.Cmd, job.Args...)
+
+	cmd := exec.CommandContext(attemptCtx, job.Cmd, job.Args...)
 	if job.Cwd != "" {
 		cmd.Dir = job.Cwd
 	}
@@ -431,62 +791,91 @@ func runOne(ctx context.Context, job Job, printCmd bool, onStarted func()) (int,
 			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
 		}
 	}
+	cmd.Env = append(cmd.Env, "RUNJOBS_BUILD_UUID="+opts.buildUUID)
+	if opts.trace {
+		cmd.Env = append(cmd.Env, "RUNJOBS_TRACE=1")
+	}
 
-	release := func() {
-		if onStarted != nil {
-			onStarted()
+	if job.Stdin != "" {
+		stdinFile, err := os.Open(job.Stdin)
+		if err != nil {
+			return 1, err, "", false
 		}
+		defer stdinFile.Close()
+		cmd.Stdin = stdinFile
 	}
-	released := false
+
+	notify := func() {
+		if onAttempt != nil {
+			onAttempt()
+		}
+	}
+	notified := false
 	defer func() {
-		if !released {
-			release()
+		if !notified {
+			notify()
 		}
 	}()
 
-	// Check if stdout/stderr are terminals to preserve colors
-	stdoutIsTTY := isTerminal(os.Stdout)
-	stderrIsTTY := isTerminal(os.Stderr)
+	var (
+		wg          sync.WaitGroup
+		logPath     string
+		stderrBytes int64
+	)
 
-	var wg sync.WaitGroup
-	if stdoutIsTTY && stderrIsTTY {
-		// Direct output to preserve colors
+	// Stdout is passed straight through when attached to a terminal, to
+	// preserve colors. Stderr always runs through the line-buffered
+	// capture below so it can be prefixed and/or logged.
+	if isTerminal(os.Stdout) {
 		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
 	} else {
-		// Use pipes when not a TTY (e.g., redirected output)
 		stdoutPipe, err := cmd.StdoutPipe()
 		if err != nil {
-			return 1, err
-		}
-		stderrPipe, err := cmd.StderrPipe()
-		if err != nil {
-			return 1, err
+			return 1, err, "", false
 		}
-
-		wg.Add(2)
+		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			_, _ = io.Copy(os.Stdout, stdoutPipe)
 		}()
-		go func() {
-			defer wg.Done()
-			_, _ = io.Copy(os.Stderr, stderrPipe)
-		}()
 	}
 
-	if printCmd {
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return 1, err, "", false
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		logPath, stderrBytes, _ = captureStderr(job, stderrPipe, opts)
+	}()
+
+	if opts.printCmd {
 		fmt.Printf("+ %s\n", formatCommand(job.Cmd, job.Args))
 	}
 
+	start := time.Now()
 	if err := cmd.Start(); err != nil {
-		return 1, err
+		return 1, err, "", false
 	}
-	release()
-	released = true
+	notify()
+	notified = true
 
-	waitErr := cmd.Wait()
+	opts.events.emit(event{
+		Type:      "job_started",
+		BuildUUID: opts.buildUUID,
+		ID:        job.ID,
+		Cmd:       job.Cmd,
+		Args:      job.Args,
+		PID:       cmd.Process.Pid,
+		Attempt:   attempt,
+	})
+
+	// Drain the pipes before Wait, which closes them once the process exits.
 	wg.Wait()
+	waitErr := cmd.Wait()
+
+	timedOut := attemptCtx.Err() != nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded)
 
 	// Extract exit code if available
 	exitCode := 0
@@ -502,7 +891,83 @@ func runOne(ctx context.Context, job Job, printCmd bool, onStarted func()) (int,
 			exitCode = 1
 		}
 	}
-	return exitCode, waitErr
+
+	opts.events.emit(event{
+		Type:        "job_finished",
+		BuildUUID:   opts.buildUUID,
+		ID:          job.ID,
+		Cmd:         job.Cmd,
+		Args:        job.Args,
+		PID:         cmd.Process.Pid,
+		Attempt:     attempt,
+		ExitCode:    exitCode,
+		DurationMs:  time.Since(start).Milliseconds(),
+		StderrBytes: stderrBytes,
+		TimedOut:    timedOut,
+	})
+
+	failed := waitErr != nil || exitCode != 0
+	if logPath != "" && !failed && !opts.keepLogs {
+		_ = os.Remove(logPath)
+		logPath = ""
+	}
+
+	return exitCode, waitErr, logPath, timedOut
+}
+
+// captureStderr streams a job's stderr line by line, optionally writing
+// each line to a per-job log file under opts.logDir and echoing it to the
+// parent's stderr with the prefix chosen below. Writes to the shared stderr are
+// serialized by opts.mu so output from concurrent jobs never interleaves
+// mid-line. It returns the log file path, if one was created.
+func captureStderr(job Job, pipe io.Reader, opts outputOptions) (string, int64, error) {
+	var (
+		logFile *os.File
+		logPath string
+		total   int64
+	)
+	if opts.logDir != "" {
+		logPath = filepath.Join(opts.logDir, job.ID+".log")
+		f, err := os.Create(logPath)
+		if err != nil {
+			return "", 0, err
+		}
+		logFile = f
+		defer logFile.Close()
+	}
+
+	// On a plain invocation with none of -prefix/-logdir/-trace, stderr
+	// streams through unprefixed exactly as it did before this capture
+	// machinery existed. A prefix is only needed once one of those was
+	// actually requested, e.g. to keep concurrent jobs' interleaved log
+	// files and live output attributable.
+	prefix := opts.prefix
+	if prefix == "" && (opts.logDir != "" || opts.trace) {
+		prefix = "[%s] "
+	}
+	if strings.Contains(prefix, "%s") {
+		prefix = fmt.Sprintf(prefix, job.ID)
+	}
+
+	// -trace always echoes prefixed lines, even if -silent was also given.
+	echo := !opts.silent || opts.trace
+
+	sc := bufio.NewScanner(pipe)
+	buf := make([]byte, 0, 64*1024)
+	sc.Buffer(buf, 10*1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		total += int64(len(line)) + 1
+		if logFile != nil {
+			fmt.Fprintln(logFile, line)
+		}
+		if echo {
+			opts.mu.Lock()
+			fmt.Fprintf(os.Stderr, "%s%s\n", prefix, line)
+			opts.mu.Unlock()
+		}
+	}
+	return logPath, total, sc.Err()
 }
 
 func formatCommand(cmd string, args []string) string {
@@ -551,3 +1016,25 @@ func ensureExecutable(bin string) (string, error) {
 	}
 	return resolved, nil
 }
+
+// parseExitCodeSet parses a comma-separated list of exit codes, as taken
+// by -no-retry-exit, into a lookup set. An empty string yields a nil
+// (empty) set.
+func parseExitCodeSet(s string) (map[int]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	set := make(map[int]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		code, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exit code %q: %w", part, err)
+		}
+		set[code] = true
+	}
+	return set, nil
+}
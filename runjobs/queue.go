@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// queuePollInterval is how often waitForQueueClaim rechecks a contended
+// lock or .done marker.
+const queuePollInterval = 200 * time.Millisecond
+
+// queueSubdir returns the <dir>/.runjobs directory that holds per-job
+// lockfiles and .done markers for -queue mode.
+func queueSubdir(dir string) string {
+	return filepath.Join(dir, ".runjobs")
+}
+
+func queueLockPath(dir, jobID string) string {
+	return filepath.Join(queueSubdir(dir), jobID+".lock")
+}
+
+func queueDonePath(dir, jobID string) string {
+	return filepath.Join(queueSubdir(dir), jobID+".done")
+}
+
+// queueJobDone reports whether jobID already has a .done marker under dir.
+func queueJobDone(dir, jobID string) bool {
+	_, err := os.Stat(queueDonePath(dir, jobID))
+	return err == nil
+}
+
+// markQueueJobDone creates jobID's .done marker under dir.
+func markQueueJobDone(dir, jobID string) error {
+	f, err := os.Create(queueDonePath(dir, jobID))
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// acquireQueueLock attempts to exclusively claim jobID's lockfile under dir
+// with a non-blocking flock, so multiple runjobs processes sharing a
+// manifest over a shared filesystem never run the same job twice. The
+// current PID is recorded in the lockfile so "runjobs clean" can later tell
+// whether the owning process is still alive. The returned file must be kept
+// open for as long as the job is claimed; closing it releases the flock.
+// ok is false, with a nil file, if another process already holds the lock.
+func acquireQueueLock(dir, jobID string) (f *os.File, ok bool, err error) {
+	if err := os.MkdirAll(queueSubdir(dir), 0o755); err != nil {
+		return nil, false, err
+	}
+	path := queueLockPath(dir, jobID)
+	lf, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := syscall.Flock(int(lf.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lf.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	if err := lf.Truncate(0); err != nil {
+		lf.Close()
+		return nil, false, err
+	}
+	if _, err := lf.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		lf.Close()
+		return nil, false, err
+	}
+	return lf, true, nil
+}
+
+// waitForQueueClaim blocks until this worker can proceed with jobID: either
+// it claims the job's lockfile itself, or it observes the job's .done
+// marker appear, meaning the process that holds the lock has since
+// finished it successfully. A single non-blocking acquireQueueLock attempt
+// cannot tell those two outcomes apart from "someone else is running it
+// right now", and treating lock contention as an immediate skip let
+// dependents of an in-flight job start before it actually finished. Callers
+// must poll rather than giving up on the first failed claim. done is true
+// only when the job finished via another process; lock is nil in that
+// case. err is ctx's error if ctx is cancelled while waiting.
+func waitForQueueClaim(ctx context.Context, dir, jobID string) (lock *os.File, done bool, err error) {
+	for {
+		if queueJobDone(dir, jobID) {
+			return nil, true, nil
+		}
+		lock, claimed, err := acquireQueueLock(dir, jobID)
+		if err != nil {
+			return nil, false, err
+		}
+		if claimed {
+			// The holder may have finished the job between the .done check
+			// above and this claim.
+			if queueJobDone(dir, jobID) {
+				lock.Close()
+				return nil, true, nil
+			}
+			return lock, false, nil
+		}
+		select {
+		case <-time.After(queuePollInterval):
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// runClean removes stale lockfiles under <dir>/.runjobs whose recorded PID
+// no longer names a live process, for the "runjobs clean <dir>" subcommand.
+// Locks still held by a live process are left alone.
+func runClean(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: runjobs clean <dir>")
+	}
+	sub := queueSubdir(args[0])
+	entries, err := os.ReadDir(sub)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".lock") {
+			continue
+		}
+		path := filepath.Join(sub, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || !processAlive(pid) {
+			if err := os.Remove(path); err == nil {
+				removed++
+			}
+		}
+	}
+	fmt.Printf("removed %d stale lock(s) from %s\n", removed, sub)
+	return nil
+}
+
+// processAlive reports whether pid names a live process, using the
+// signal-0 idiom: sending signal 0 performs error checking without
+// actually delivering a signal.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = proc.Signal(syscall.Signal(0))
+	// EPERM means the process exists but belongs to another user.
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// dagNode tracks one job's place in the dependency graph. done is closed
+// once the job (or its skip) has been decided; failed is written once by
+// the node's own goroutine before done is closed, so later reads by
+// dependents after <-done are race-free without extra locking.
+type dagNode struct {
+	job    Job
+	done   chan struct{}
+	failed bool
+}
+
+// buildDAG indexes jobs by ID and validates their Needs edges, detecting
+// cycles up front with Kahn's algorithm: repeatedly remove nodes whose
+// in-degree has dropped to zero, decrementing their successors; any node
+// left afterward is part of a cycle or depends on one, and all such nodes
+// are reported. order lists job IDs in manifest order; runJobs launches
+// jobs in that order, but the order in which they actually start running
+// is not guaranteed to follow it.
+func buildDAG(jobs []Job) (map[string]*dagNode, []string, error) {
+	nodes := make(map[string]*dagNode, len(jobs))
+	order := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		if _, dup := nodes[j.ID]; dup {
+			return nil, nil, fmt.Errorf("duplicate job id %q", j.ID)
+		}
+		nodes[j.ID] = &dagNode{job: j, done: make(chan struct{})}
+		order = append(order, j.ID)
+	}
+
+	remaining := make(map[string]int, len(nodes))
+	dependents := make(map[string][]string, len(nodes))
+	for id, n := range nodes {
+		for _, need := range n.job.Needs {
+			if _, ok := nodes[need]; !ok {
+				return nil, nil, fmt.Errorf("job %q needs unknown job %q", id, need)
+			}
+			remaining[id]++
+			dependents[need] = append(dependents[need], id)
+		}
+	}
+
+	queue := make([]string, 0, len(order))
+	for _, id := range order {
+		if remaining[id] == 0 {
+			queue = append(queue, id)
+		}
+	}
+	visited := 0
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		visited++
+		for _, dep := range dependents[id] {
+			remaining[dep]--
+			if remaining[dep] == 0 {
+				queue = append(queue, dep)
+			}
+		}
+	}
+	if visited != len(nodes) {
+		var cyclic []string
+		for id, left := range remaining {
+			if left > 0 {
+				cyclic = append(cyclic, id)
+			}
+		}
+		sort.Strings(cyclic)
+		return nil, nil, fmt.Errorf("dependency cycle detected among jobs: %s", strings.Join(cyclic, ", "))
+	}
+
+	return nodes, order, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// event is one line of the JSON-Lines stream written by -json. Fields are
+// populated according to Type; unused fields are omitted.
+type event struct {
+	Type         string   `json:"type"`
+	Time         string   `json:"time"`
+	BuildUUID    string   `json:"build_uuid"`
+	ID           string   `json:"id,omitempty"`
+	Cmd          string   `json:"cmd,omitempty"`
+	Args         []string `json:"args,omitempty"`
+	PID          int      `json:"pid,omitempty"`
+	Attempt      int      `json:"attempt,omitempty"`
+	ExitCode     int      `json:"exit_code,omitempty"`
+	DurationMs   int64    `json:"duration_ms,omitempty"`
+	StderrBytes  int64    `json:"stderr_bytes,omitempty"`
+	TimedOut     bool     `json:"timed_out,omitempty"`
+	Total        int      `json:"total,omitempty"`
+	Success      int      `json:"success,omitempty"`
+	Failed       int      `json:"failed,omitempty"`
+	Skipped      int      `json:"skipped,omitempty"`
+	QueueSkipped int      `json:"queue_skipped,omitempty"`
+}
+
+// eventLog writes a JSON-Lines event stream to a file. A nil *eventLog is
+// valid and every method on it is a no-op, so callers can pass it around
+// unconditionally whether or not -json was given.
+type eventLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func newEventLog(path string) (*eventLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (l *eventLog) emit(ev event) {
+	if l == nil {
+		return
+	}
+	ev.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_ = l.enc.Encode(ev)
+}
+
+func (l *eventLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// newBuildUUID generates a run-level UUID (RFC 4122 v4), mirroring
+// goredo's REDO_BUILD_UUID so nested runjobs invocations can be
+// correlated through RUNJOBS_BUILD_UUID.
+func newBuildUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// runReport summarizes the JSON-Lines event log(s) produced by -json,
+// grouped by build UUID, for the "runjobs report <file.jsonl>" subcommand.
+func runReport(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: runjobs report <file.jsonl>")
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	type runSummary struct {
+		buildUUID                                           string
+		started, finished                                   time.Time
+		total, success, failed, skipped, queueSkipped, jobs int
+	}
+	summaries := make(map[string]*runSummary)
+	var order []string
+
+	sc := bufio.NewScanner(f)
+	buf := make([]byte, 0, 64*1024)
+	sc.Buffer(buf, 10*1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var ev event
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			return fmt.Errorf("parse %q: %w", line, err)
+		}
+		s := summaries[ev.BuildUUID]
+		if s == nil {
+			s = &runSummary{buildUUID: ev.BuildUUID}
+			summaries[ev.BuildUUID] = s
+			order = append(order, ev.BuildUUID)
+		}
+		switch ev.Type {
+		case "run_started":
+			s.started, _ = time.Parse(time.RFC3339Nano, ev.Time)
+		case "run_finished":
+			s.finished, _ = time.Parse(time.RFC3339Nano, ev.Time)
+			s.total, s.success, s.failed, s.skipped, s.queueSkipped = ev.Total, ev.Success, ev.Failed, ev.Skipped, ev.QueueSkipped
+		case "job_finished":
+			s.jobs++
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range order {
+		s := summaries[id]
+		fmt.Printf("run %s: total=%d success=%d failed=%d skipped=%d queue_skipped=%d jobs_logged=%d duration=%s\n",
+			s.buildUUID, s.total, s.success, s.failed, s.skipped, s.queueSkipped, s.jobs, s.finished.Sub(s.started))
+	}
+	return nil
+}